@@ -0,0 +1,674 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package activitypub imports a remote actor's ActivityPub outbox - as
+// served by WriteFreely, Mastodon, Plume and owl-blogs - into Verbis. It
+// sits alongside wordpress as a second importer, sharing the same
+// ImporterConfig mapping rules, progress plumbing and media pipeline so
+// callers can treat either source identically.
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ainsleyclark/verbis/api/domain"
+	"github.com/ainsleyclark/verbis/api/errors"
+	"github.com/ainsleyclark/verbis/api/importer"
+	"github.com/ainsleyclark/verbis/api/importer/wordpress"
+	"github.com/ainsleyclark/verbis/api/store"
+	"github.com/gookit/color"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Convert imports a single actor's outbox into Verbis, producing the
+// same Result shape as wordpress.Convert.
+//
+// Exactly one of Source or OfflineFile identifies the outbox: Source is
+// a live actor or outbox URL, walked page by page via its "next" links;
+// OfflineFile is a previously downloaded outbox.json, read as a single
+// page, for reruns without hitting the network.
+type Convert struct {
+	Source      string
+	OfflineFile string
+
+	store *store.Repository
+	owner domain.User
+
+	// Config declares how imported posts are mapped onto Verbis
+	// resources, using the same MappingRules as wordpress.Convert.
+	Config *wordpress.ImporterConfig
+	// Progress receives a stream of wordpress.Events as the import
+	// runs, reusing wordpress's Kind/Status vocabulary so a caller can
+	// render both importers the same way.
+	Progress wordpress.ProgressWriter
+	// RateLimit is slept between live outbox page fetches. Defaults to
+	// 500ms.
+	RateLimit time.Duration
+	// Onboarding notifies newly created authors of their account,
+	// reusing wordpress.AuthorOnboarding so both importers share the
+	// same email/magic-link/no-op behaviour. Defaults to NoopNotifier.
+	Onboarding wordpress.AuthorOnboarding
+	// PasswordPolicy controls the strength of passwords createUser
+	// generates for imported authors.
+	PasswordPolicy wordpress.PasswordPolicy
+	// PrintPasswords allows createUser to print generated passwords to
+	// stdout. Passwords are never printed otherwise.
+	PrintPasswords bool
+
+	client *http.Client
+	media  *wordpress.MediaPipeline
+
+	authorIDs map[string]int
+	authors   domain.Users
+	authorsMu sync.Mutex
+
+	failed   Failures
+	failedMu sync.Mutex
+}
+
+// Result mirrors wordpress.Result so a caller can treat either importer
+// the same way.
+type Result struct {
+	Failed     Failures
+	Posts      domain.PostData
+	Authors    domain.UsersParts
+	Categories domain.Categories
+}
+
+// Failures collects the errors that occurred while importing an outbox.
+type Failures struct {
+	Posts   []FailedPost
+	Authors []FailedAuthor
+}
+
+// FailedPost describes an Object that failed to import, along with any
+// of its attachments that failed to upload.
+type FailedPost struct {
+	Object Object
+	Media  []wordpress.FailedMedia
+	Error  error
+}
+
+// FailedAuthor describes an actor whose Person document could not be
+// resolved, or whose Verbis user could not be found or created.
+type FailedAuthor struct {
+	ActorID string
+	Error   error
+}
+
+// Option configures a Convert returned from New or NewFromFile.
+type Option func(*Convert)
+
+// WithRateLimit overrides the delay slept between live outbox page
+// fetches.
+func WithRateLimit(d time.Duration) Option {
+	return func(c *Convert) {
+		c.RateLimit = d
+	}
+}
+
+// WithProgress overrides Convert's default ProgressWriter.
+func WithProgress(p wordpress.ProgressWriter) Option {
+	return func(c *Convert) {
+		c.Progress = p
+	}
+}
+
+// WithHTTPClient overrides the client used to fetch actors and outbox
+// pages.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Convert) {
+		c.client = client
+	}
+}
+
+// WithMediaPipeline shares a wordpress.MediaPipeline (and therefore its
+// content-hash dedupe cache) between a wordpress.Convert and this
+// Convert, so an image referenced from both imports is only uploaded
+// once.
+func WithMediaPipeline(m *wordpress.MediaPipeline) Option {
+	return func(c *Convert) {
+		c.media = m
+	}
+}
+
+// WithOnboarding overrides how Convert notifies newly created authors
+// of their account. Defaults to wordpress.NoopNotifier.
+func WithOnboarding(o wordpress.AuthorOnboarding) Option {
+	return func(c *Convert) {
+		c.Onboarding = o
+	}
+}
+
+// WithPasswordPolicy overrides the strength of passwords generated for
+// imported authors.
+func WithPasswordPolicy(p wordpress.PasswordPolicy) Option {
+	return func(c *Convert) {
+		c.PasswordPolicy = p
+	}
+}
+
+// WithPrintPasswords allows createUser to print generated passwords to
+// stdout. Passwords are never printed unless this is set.
+func WithPrintPasswords() Option {
+	return func(c *Convert) {
+		c.PrintPasswords = true
+	}
+}
+
+// New constructs a Convert that imports actorOrOutboxURL live over
+// HTTP, walking every page.
+func New(actorOrOutboxURL string, s *store.Repository, cfg *wordpress.ImporterConfig, opts ...Option) *Convert {
+	if cfg == nil {
+		cfg = wordpress.DefaultImporterConfig()
+	}
+
+	c := &Convert{
+		Source:         actorOrOutboxURL,
+		store:          s,
+		owner:          s.User.Owner(),
+		Config:         cfg,
+		Progress:       wordpress.NewTerminalProgressWriter(os.Stdout),
+		RateLimit:      500 * time.Millisecond,
+		client:         http.DefaultClient,
+		media:          wordpress.NewMediaPipeline(wordpress.DefaultMediaConfig()),
+		authorIDs:      map[string]int{},
+		Onboarding:     wordpress.NoopNotifier{},
+		PasswordPolicy: wordpress.DefaultPasswordPolicy(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// NewFromFile constructs a Convert that imports a single, previously
+// downloaded outbox page from path instead of fetching it live.
+func NewFromFile(path string, s *store.Repository, cfg *wordpress.ImporterConfig, opts ...Option) *Convert {
+	c := New("", s, cfg, opts...)
+	c.OfflineFile = path
+	return c
+}
+
+// Import fetches the outbox (live or offline), then imports every
+// Create Note or Article it contains as a Verbis post. Progress is
+// reported in real time through Convert.Progress.
+func (c *Convert) Import(ctx context.Context) (Result, error) {
+	activities, err := c.fetchOutbox(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var notes []Activity
+	for _, a := range activities {
+		if a.isCreateNote() {
+			notes = append(notes, a)
+		}
+	}
+
+	out := make(chan wordpress.Event, 64)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for e := range out {
+			c.Progress.WriteProgress(e)
+		}
+	}()
+
+	var (
+		posts      domain.PostData
+		categories domain.Categories
+	)
+
+	total := len(notes)
+loop:
+	for i, activity := range notes {
+		select {
+		case <-ctx.Done():
+			break loop
+		default:
+		}
+
+		current := i + 1
+		out <- wordpress.Event{Kind: wordpress.EventPost, ID: activity.Object.ID, Status: wordpress.StatusStarted, Current: current, Total: total}
+
+		post, category, ok := c.addObject(ctx, activity.Object, out, current, total)
+		if !ok {
+			continue
+		}
+
+		posts = append(posts, post)
+		if category != nil {
+			categories = append(categories, *category)
+		}
+	}
+
+	close(out)
+	<-drained
+
+	authors := make(domain.UsersParts, 0, len(c.authors))
+	for _, u := range c.authors {
+		authors = append(authors, u.HideCredentials())
+	}
+
+	return Result{
+		Failed:     c.failed,
+		Posts:      posts,
+		Authors:    authors,
+		Categories: categories,
+	}, nil
+}
+
+// addObject creates the Verbis post for a single Note or Article.
+// Returns ok false if the object could not be imported, in which case
+// it has already been appended to Convert.failed and a failed Event has
+// been sent to out.
+func (c *Convert) addObject(ctx context.Context, obj Object, out chan<- wordpress.Event, current, total int) (post domain.Post, category *domain.Category, ok bool) {
+	fail := func(media []wordpress.FailedMedia, err error) {
+		c.failPost(obj, media, err)
+		out <- wordpress.Event{Kind: wordpress.EventPost, ID: obj.ID, Status: wordpress.StatusFailed, Current: current, Total: total, Err: err}
+	}
+
+	link, err := importer.ParseLink(obj.ID)
+	if err != nil {
+		fail(nil, err)
+		return domain.Post{}, nil, false
+	}
+
+	rule, err := c.Config.RuleFor(tagsToCategories(obj.Tag))
+	if err != nil {
+		fail(nil, err)
+		return domain.Post{}, nil, false
+	}
+
+	uuid, err := importer.ParseUUID(rule.ContentField.UUID)
+	if err != nil {
+		fail(nil, err)
+		return domain.Post{}, nil, false
+	}
+
+	content, err := c.parseContent(obj.Content, out)
+	if err != nil {
+		fail(nil, err)
+		return domain.Post{}, nil, false
+	}
+
+	attachmentsHTML, failedMedia := c.processAttachments(obj.Attachment, out)
+	content += attachmentsHTML
+
+	author, err := c.resolveAuthor(ctx, obj.AttributedTo, out)
+	if err != nil {
+		author = c.owner.Id
+	}
+
+	title := obj.Name
+	if title == "" {
+		title = link
+	}
+
+	published := obj.Published
+
+	p := domain.PostCreate{
+		Post: domain.Post{
+			Slug:         rule.RenderSlug(link, published.Year()),
+			Title:        title,
+			Status:       "published",
+			Resource:     rule.Resource,
+			PageTemplate: rule.PageTemplate,
+			PageLayout:   rule.PageLayout,
+			PublishedAt:  &published,
+			CreatedAt:    published,
+			UpdatedAt:    published,
+		},
+		Author: author,
+		Fields: domain.PostFields{
+			{
+				UUID:          uuid,
+				Type:          string(rule.ContentField.Type),
+				Name:          "content",
+				OriginalValue: domain.FieldValue(content),
+			},
+		},
+	}
+
+	cat, err := c.getCategory(obj.Tag, rule)
+	if err == nil {
+		cid := cat.Id
+		p.Category = &cid
+		category = &cat
+	}
+
+	post, err = c.store.Posts.Create(p)
+	if err != nil {
+		fail(failedMedia, err)
+		return domain.Post{}, nil, false
+	}
+
+	if len(failedMedia) > 0 {
+		c.failPost(obj, failedMedia, fmt.Errorf("%d attachments failed to upload", len(failedMedia)))
+	}
+
+	out <- wordpress.Event{Kind: wordpress.EventPost, ID: obj.ID, Status: wordpress.StatusOK, Current: current, Total: total}
+	return post, category, true
+}
+
+// parseContent uploads every image importer.ParseHTML discovers in
+// content through Convert.media, so the same download/retry/dedupe
+// logic wordpress.Convert uses applies here too.
+func (c *Convert) parseContent(content string, out chan<- wordpress.Event) (string, error) {
+	return importer.ParseHTML(content, func(fh *multipart.FileHeader, url string, err error) string {
+		if err != nil {
+			// ParseHTML made a single download attempt and it failed;
+			// retry url through the media pipeline's own retrying download.
+			uri, ferr := c.media.Fetch(url, c.owner.Token, c.store.Media.Upload)
+			if ferr == nil {
+				out <- wordpress.Event{Kind: wordpress.EventMedia, ID: url, Status: wordpress.StatusOK}
+				return uri
+			}
+			err = ferr
+		}
+
+		if err != nil {
+			out <- wordpress.Event{Kind: wordpress.EventMedia, ID: url, Status: wordpress.StatusFailed, Err: err}
+			return ""
+		}
+
+		uri, uerr := c.media.UploadFetched(fh, url, c.owner.Token, c.store.Media.Upload)
+		if uerr != nil {
+			out <- wordpress.Event{Kind: wordpress.EventMedia, ID: url, Status: wordpress.StatusFailed, Err: uerr}
+			return ""
+		}
+
+		out <- wordpress.Event{Kind: wordpress.EventMedia, ID: url, Status: wordpress.StatusOK}
+		return uri
+	})
+}
+
+// processAttachments uploads an Object's Document/Image attachments
+// through the same media pipeline as its inline content images, and
+// returns the HTML needed to append them to the post's content so an
+// uploaded attachment is still referenced from the imported post.
+func (c *Convert) processAttachments(attachments []Attachment, out chan<- wordpress.Event) (string, []wordpress.FailedMedia) {
+	var (
+		html   strings.Builder
+		failed []wordpress.FailedMedia
+	)
+
+	for _, a := range attachments {
+		if a.URL == "" {
+			continue
+		}
+
+		out <- wordpress.Event{Kind: wordpress.EventMedia, ID: a.URL, Status: wordpress.StatusStarted}
+
+		uri, err := c.media.Fetch(a.URL, c.owner.Token, c.store.Media.Upload)
+		if err != nil {
+			failed = append(failed, wordpress.FailedMedia{URL: a.URL, Error: err})
+			out <- wordpress.Event{Kind: wordpress.EventMedia, ID: a.URL, Status: wordpress.StatusFailed, Err: err}
+			continue
+		}
+
+		if strings.HasPrefix(a.MediaType, "image/") || a.Type == "Image" {
+			fmt.Fprintf(&html, `<img src="%s">`, uri)
+		} else {
+			fmt.Fprintf(&html, `<a href="%s">%s</a>`, uri, path.Base(a.URL))
+		}
+
+		out <- wordpress.Event{Kind: wordpress.EventMedia, ID: a.URL, Status: wordpress.StatusOK}
+	}
+
+	return html.String(), failed
+}
+
+// tagsToCategories adapts an Object's Hashtag tags into wordpress.Category
+// values so they can be resolved through wordpress.ImporterConfig.RuleFor
+// and Convert.getCategory without a second mapping-rule implementation.
+func tagsToCategories(tags []Tag) []wordpress.Category {
+	cats := make([]wordpress.Category, 0, len(tags))
+	for _, t := range tags {
+		if t.Type != "Hashtag" {
+			continue
+		}
+		name := strings.TrimPrefix(t.Name, "#")
+		cats = append(cats, wordpress.Category{URLSlug: name, DisplayName: name})
+	}
+	return cats
+}
+
+// getCategory converts an Object's first Hashtag tag into a
+// domain.Category, creating it if it doesn't already exist. Returns
+// errors.NOTFOUND if the object carries no Hashtag tag.
+func (c *Convert) getCategory(tags []Tag, rule wordpress.MappingRule) (domain.Category, error) {
+	const op = "activitypub.getCategory"
+
+	cats := tagsToCategories(tags)
+	if len(cats) == 0 {
+		return domain.Category{}, &errors.Error{Code: errors.NOTFOUND, Message: "No hashtag is attached to the object.", Operation: op}
+	}
+
+	wp := cats[0]
+	cat := domain.Category{
+		Slug:     wp.URLSlug,
+		Name:     wp.DisplayName,
+		Resource: rule.Resource,
+	}
+
+	return c.store.Categories.Create(cat)
+}
+
+// resolveAuthor maps an Object's attributedTo actor URL onto a Verbis
+// user, fetching the remote Person actor and caching the resolved user
+// for the lifetime of Convert. Only successful resolutions are cached:
+// an actor whose fetch or user lookup fails is fetched again the next
+// time an object references it.
+func (c *Convert) resolveAuthor(ctx context.Context, actorID string, out chan<- wordpress.Event) (int, error) {
+	if actorID == "" {
+		return c.owner.Id, nil
+	}
+
+	c.authorsMu.Lock()
+	if id, ok := c.authorIDs[actorID]; ok {
+		c.authorsMu.Unlock()
+		return id, nil
+	}
+	c.authorsMu.Unlock()
+
+	out <- wordpress.Event{Kind: wordpress.EventAuthor, ID: actorID, Status: wordpress.StatusStarted}
+
+	actor, err := c.fetchActor(ctx, actorID)
+	if err != nil {
+		c.failAuthor(actorID, err)
+		out <- wordpress.Event{Kind: wordpress.EventAuthor, ID: actorID, Status: wordpress.StatusFailed, Err: err}
+		return c.owner.Id, err
+	}
+
+	email := actor.Email
+	if email == "" {
+		// Most ActivityPub servers never expose an email on the actor
+		// document; fall back to a deterministic placeholder so the
+		// same actor always maps to the same Verbis user.
+		email = fmt.Sprintf("%s@imported.invalid", actor.PreferredUsername)
+	}
+
+	var user domain.User
+	if c.store.User.ExistsByEmail(email) {
+		user, err = c.store.User.FindByEmail(email)
+	} else {
+		user, err = c.createUser(actor, email)
+	}
+	if err != nil {
+		c.failAuthor(actorID, err)
+		out <- wordpress.Event{Kind: wordpress.EventAuthor, ID: actorID, Status: wordpress.StatusFailed, Err: err}
+		return c.owner.Id, err
+	}
+
+	c.authorsMu.Lock()
+	c.authorIDs[actorID] = user.Id
+	c.authors = append(c.authors, user)
+	c.authorsMu.Unlock()
+
+	out <- wordpress.Event{Kind: wordpress.EventAuthor, ID: actorID, Status: wordpress.StatusOK}
+	return user.Id, nil
+}
+
+// createUser generates a new password and creates a Verbis user for a
+// remote actor that has never been imported before. Authors aren't tied
+// to a single outbox category, so the new user is given the Config
+// Default rule's author role, the same as wordpress.Convert.createUser.
+// The new author is notified through Convert.Onboarding; the plaintext
+// password is only ever printed to stdout if PrintPasswords is set.
+func (c *Convert) createUser(actor Actor, email string) (domain.User, error) {
+	password := wordpress.CreatePassword(c.PasswordPolicy)
+
+	name := actor.Name
+	if name == "" {
+		name = actor.PreferredUsername
+	}
+
+	user := domain.UserCreate{
+		User: domain.User{
+			UserPart: domain.UserPart{
+				FirstName: name,
+				Email:     email,
+				Role: domain.Role{
+					Id: c.Config.Default.AuthorRoleID,
+				},
+			},
+		},
+		Password:        password,
+		ConfirmPassword: password,
+	}
+
+	u, err := c.store.User.Create(user)
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	if c.PrintPasswords {
+		color.Green.Println(fmt.Sprintf("User: %s Password: %s", u.Email, password))
+	}
+
+	if err := c.Onboarding.Onboard(u, password); err != nil {
+		color.Red.Println(err)
+	}
+
+	return u, nil
+}
+
+// fetchOutbox returns every activity in Convert's outbox, from
+// OfflineFile if set, otherwise by walking Source live.
+func (c *Convert) fetchOutbox(ctx context.Context) ([]Activity, error) {
+	if c.OfflineFile != "" {
+		return c.fetchOutboxOffline()
+	}
+	return c.fetchOutboxLive(ctx)
+}
+
+// fetchOutboxOffline reads a single, previously downloaded outbox page
+// from OfflineFile.
+func (c *Convert) fetchOutboxOffline() ([]Activity, error) {
+	const op = "activitypub.fetchOutboxOffline"
+
+	b, err := ioutil.ReadFile(c.OfflineFile)
+	if err != nil {
+		return nil, &errors.Error{Code: errors.INTERNAL, Message: "Could not read offline outbox file.", Operation: op, Err: err}
+	}
+
+	var page OrderedCollectionPage
+	if err := json.Unmarshal(b, &page); err != nil {
+		return nil, &errors.Error{Code: errors.INVALID, Message: "Could not parse offline outbox file.", Operation: op, Err: err}
+	}
+
+	return page.OrderedItems, nil
+}
+
+// fetchOutboxLive walks every page of Convert.Source, following Next
+// until the outbox is exhausted, sleeping RateLimit between pages.
+// Source may be an actor URL, in which case its Outbox is resolved
+// first, or an outbox URL directly.
+func (c *Convert) fetchOutboxLive(ctx context.Context) ([]Activity, error) {
+	const op = "activitypub.fetchOutboxLive"
+
+	url := c.Source
+	if actor, err := c.fetchActor(ctx, c.Source); err == nil && actor.Outbox != "" {
+		url = actor.Outbox
+	}
+
+	var activities []Activity
+	for url != "" {
+		var page OrderedCollectionPage
+		if err := c.getJSON(ctx, url, &page); err != nil {
+			return nil, &errors.Error{Code: errors.INTERNAL, Message: "Could not fetch outbox page.", Operation: op, Err: err}
+		}
+
+		activities = append(activities, page.OrderedItems...)
+		url = page.Next
+
+		if url != "" {
+			time.Sleep(c.RateLimit)
+		}
+	}
+
+	return activities, nil
+}
+
+// fetchActor fetches and decodes the Person actor document at id.
+func (c *Convert) fetchActor(ctx context.Context, id string) (Actor, error) {
+	var actor Actor
+	err := c.getJSON(ctx, id, &actor)
+	return actor, err
+}
+
+// getJSON fetches url with the ActivityStreams Accept header and
+// decodes its body into v.
+func (c *Convert) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// failPost appends to the failed posts array.
+func (c *Convert) failPost(obj Object, media []wordpress.FailedMedia, err error) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
+	c.failed.Posts = append(c.failed.Posts, FailedPost{
+		Object: obj,
+		Media:  media,
+		Error:  err,
+	})
+}
+
+// failAuthor appends to the failed authors array.
+func (c *Convert) failAuthor(actorID string, err error) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
+	c.failed.Authors = append(c.failed.Authors, FailedAuthor{
+		ActorID: actorID,
+		Error:   err,
+	})
+}
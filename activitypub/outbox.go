@@ -0,0 +1,73 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package activitypub
+
+import "time"
+
+// Actor is the subset of an ActivityPub actor document needed to resolve
+// attributedTo into a Verbis author. Populated from WriteFreely,
+// Mastodon, Plume and owl-blogs actor responses alike, which all agree
+// on these fields.
+type Actor struct {
+	ID                string `json:"id"`
+	PreferredUsername string `json:"preferredUsername"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	Outbox            string `json:"outbox"`
+}
+
+// OrderedCollectionPage is a single page of an actor's outbox. The first
+// page may be the OrderedCollection itself with its items inlined, in
+// which case Next is empty and there is nothing further to walk.
+type OrderedCollectionPage struct {
+	Type         string     `json:"type"`
+	OrderedItems []Activity `json:"orderedItems"`
+	Next         string     `json:"next"`
+}
+
+// Activity is an outbox entry. Only Create activities wrapping a Note or
+// Article are imported; anything else (Like, Announce, Delete...) is
+// skipped.
+type Activity struct {
+	Type   string `json:"type"`
+	Object Object `json:"object"`
+}
+
+// Object is the Note or Article a Create activity publishes.
+type Object struct {
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	AttributedTo string       `json:"attributedTo"`
+	Name         string       `json:"name"`
+	Content      string       `json:"content"`
+	Published    time.Time    `json:"published"`
+	Tag          []Tag        `json:"tag"`
+	Attachment   []Attachment `json:"attachment"`
+}
+
+// Tag is a Hashtag attached to an Object, mapped onto a Verbis category.
+// Mention tags also appear here and are ignored, since only Hashtag
+// carries a category-worthy Name.
+type Tag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// Attachment is a Document or Image referenced by an Object, routed
+// through wordpress.MediaPipeline the same way post media is.
+type Attachment struct {
+	Type      string `json:"type"`
+	URL       string `json:"url"`
+	MediaType string `json:"mediaType"`
+}
+
+// isCreateNote reports whether a is a Create wrapping a Note or Article,
+// the only activity type this importer understands.
+func (a Activity) isCreateNote() bool {
+	if a.Type != "Create" {
+		return false
+	}
+	return a.Object.Type == "Note" || a.Object.Type == "Article"
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wordpress
+
+import (
+	"github.com/ainsleyclark/verbis/api/domain"
+	"time"
+)
+
+// Checkpoint statuses recorded against a domain.ImportedItem. "ok" is
+// the only status that causes addItem and getCategory to skip
+// re-importing an entity on a resumed run; anything else (failed, or a
+// dry run placeholder) is retried. createUser only writes author
+// checkpoints: populateAuthors skips an author whose email already
+// belongs to a Verbis user, without consulting them.
+const (
+	checkpointOK     = "ok"
+	checkpointFailed = "failed"
+	checkpointDryRun = "dry_run"
+)
+
+// Option configures a Convert returned from New.
+type Option func(*Convert)
+
+// WithResume reruns a previously started import job, skipping any
+// Wordpress guid, author email or category slug already checkpointed
+// as "ok" and retrying anything checkpointed as failed.
+func WithResume(jobID string) Option {
+	return func(c *Convert) {
+		c.jobID = jobID
+		c.resuming = true
+	}
+}
+
+// WithDryRun runs the import without writing any Posts, Users or
+// Categories - it only writes checkpoint records describing what would
+// have happened, so a real run can be previewed first.
+func WithDryRun() Option {
+	return func(c *Convert) {
+		c.DryRun = true
+	}
+}
+
+// startJob creates a new domain.ImportJob unless Convert is resuming an
+// existing one, in which case the existing job is reused as-is.
+func (c *Convert) startJob() error {
+	if c.resuming {
+		return nil
+	}
+
+	job, err := c.store.ImportJobs.Create(domain.ImportJob{
+		Source:    c.source,
+		StartedAt: time.Now(),
+		State:     "running",
+	})
+	if err != nil {
+		return err
+	}
+
+	c.jobID = job.JobID
+	return nil
+}
+
+// finishJob marks Convert's job as finished.
+func (c *Convert) finishJob() {
+	now := time.Now()
+	_, _ = c.store.ImportJobs.Update(c.jobID, domain.ImportJob{
+		FinishedAt: &now,
+		State:      "completed",
+	})
+}
+
+// checkpoint looks up a previously recorded domain.ImportedItem for
+// this import job by kind and key (a Wordpress guid, author email or
+// category slug). found is false if nothing has been recorded yet.
+func (c *Convert) checkpoint(kind EventKind, key string) (item domain.ImportedItem, found bool) {
+	if key == "" {
+		return domain.ImportedItem{}, false
+	}
+
+	item, err := c.store.ImportedItems.Find(c.jobID, string(kind), key)
+	if err != nil {
+		return domain.ImportedItem{}, false
+	}
+
+	return item, true
+}
+
+// writeCheckpoint records the outcome of importing a single entity so a
+// later WithResume run can skip or retry it.
+func (c *Convert) writeCheckpoint(kind EventKind, key string, verbisID int, status string) {
+	if key == "" {
+		return
+	}
+
+	_, _ = c.store.ImportedItems.Upsert(domain.ImportedItem{
+		JobID:    c.jobID,
+		WPGuid:   key,
+		Kind:     string(kind),
+		VerbisID: verbisID,
+		Status:   status,
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wordpress
+
+import (
+	"encoding/json"
+	"github.com/ainsleyclark/verbis/api/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FieldType describes how a post's content field should be stored.
+type FieldType string
+
+const (
+	FieldTypeRichText FieldType = "richtext"
+	FieldTypeMarkdown FieldType = "markdown"
+	FieldTypeBlock    FieldType = "block"
+)
+
+// ContentField describes the Verbis field a Wordpress post's body is
+// written into.
+type ContentField struct {
+	UUID string    `json:"uuid" yaml:"uuid"`
+	Type FieldType `json:"type" yaml:"type"`
+}
+
+// MappingRule declares how Wordpress posts carrying a given category
+// slug should be mapped onto a Verbis Resource, layout, template and
+// content field. Leave CategorySlug empty for the rule used as an
+// ImporterConfig's Default.
+type MappingRule struct {
+	CategorySlug string       `json:"category_slug" yaml:"category_slug"`
+	Resource     string       `json:"resource" yaml:"resource"`
+	PageLayout   string       `json:"page_layout" yaml:"page_layout"`
+	PageTemplate string       `json:"page_template" yaml:"page_template"`
+	ContentField ContentField `json:"content_field" yaml:"content_field"`
+	AuthorRoleID int          `json:"author_role_id" yaml:"author_role_id"`
+	// SlugFormat is rendered with {resource}, {year} and {slug}
+	// placeholders, e.g. "/{resource}/{year}/{slug}".
+	SlugFormat string `json:"slug_format" yaml:"slug_format"`
+}
+
+// ImporterConfig declares how Wordpress posts are mapped onto Verbis
+// resources. Rules are tried in the order they're declared; Default is
+// used when no Rule's CategorySlug matches a post.
+type ImporterConfig struct {
+	Rules   []MappingRule `json:"rules" yaml:"rules"`
+	Default MappingRule   `json:"default" yaml:"default"`
+}
+
+// DefaultImporterConfig reproduces the values the importer used to have
+// hard coded, so a caller that doesn't supply its own ImporterConfig
+// still gets a working default rule.
+func DefaultImporterConfig() *ImporterConfig {
+	return &ImporterConfig{
+		Default: MappingRule{
+			Resource:     "news",
+			PageLayout:   "main",
+			PageTemplate: "news-single",
+			ContentField: ContentField{
+				UUID: "2dedc760-5016-11eb-ae93-0242ac130002",
+				Type: FieldTypeRichText,
+			},
+			AuthorRoleID: 2,
+			SlugFormat:   "/{resource}/{slug}",
+		},
+	}
+}
+
+// LoadImporterConfig reads a YAML or JSON import profile from path,
+// selecting the format by file extension (.yml, .yaml or .json) so an
+// operator can commit an import profile to their repo and re-run it
+// deterministically.
+func LoadImporterConfig(path string) (*ImporterConfig, error) {
+	const op = "wordpress.LoadImporterConfig"
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &errors.Error{Code: errors.INTERNAL, Message: "Could not read importer config file.", Operation: op, Err: err}
+	}
+
+	cfg := &ImporterConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(b, cfg)
+	case ".json":
+		err = json.Unmarshal(b, cfg)
+	default:
+		return nil, &errors.Error{Code: errors.INVALID, Message: "Unsupported importer config format, expected .yml, .yaml or .json.", Operation: op}
+	}
+	if err != nil {
+		return nil, &errors.Error{Code: errors.INVALID, Message: "Could not parse importer config file.", Operation: op, Err: err}
+	}
+
+	return cfg, nil
+}
+
+// RuleFor resolves the MappingRule that applies to a Wordpress post
+// given its categories, falling back to Default. It returns
+// errors.NOTFOUND if no Rule matches and no Default has been configured,
+// so the caller can surface the failure through Convert.Failures.
+func (m *ImporterConfig) RuleFor(categories []Category) (MappingRule, error) {
+	const op = "ImporterConfig.RuleFor"
+
+	for _, rule := range m.Rules {
+		for _, wp := range categories {
+			if rule.CategorySlug != "" && rule.CategorySlug == wp.URLSlug {
+				return rule, nil
+			}
+		}
+	}
+
+	if m.Default.Resource != "" {
+		return m.Default, nil
+	}
+
+	return MappingRule{}, &errors.Error{Code: errors.NOTFOUND, Message: "No mapping rule matched the Wordpress item and no default rule was configured.", Operation: op}
+}
+
+// RenderSlug applies the rule's SlugFormat to a post's link derived
+// slug and publish year, e.g. "/{resource}/{year}/{slug}".
+func (r MappingRule) RenderSlug(link string, year int) string {
+	format := r.SlugFormat
+	if format == "" {
+		format = "/{resource}/{slug}"
+	}
+
+	replacer := strings.NewReplacer(
+		"{resource}", r.Resource,
+		"{year}", strconv.Itoa(year),
+		"{slug}", strings.ReplaceAll(link, "/", ""),
+	)
+
+	return replacer.Replace(format)
+}
@@ -0,0 +1,412 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wordpress
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ainsleyclark/verbis/api/domain"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MediaConfig controls how parseContent downloads and deduplicates the
+// images discovered by importer.ParseHTML. ParseHTML makes the first
+// download attempt for each image itself; MaxRetries, OfflineDir and
+// HTTPClient apply to the pipeline's own downloads, which parseContent
+// falls back to when that first attempt fails.
+type MediaConfig struct {
+	// Concurrency bounds how many media items the pipeline downloads or
+	// uploads at once, across every post worker. ParseHTML's own first
+	// download attempt is not bounded by it. Defaults to runtime.NumCPU().
+	Concurrency int
+	// MaxFileBytes rejects any single file larger than this. Zero means
+	// unlimited.
+	MaxFileBytes int64
+	// MaxTotalBytes caps the cumulative size of every file downloaded
+	// during the import. Zero means unlimited.
+	MaxTotalBytes int64
+	// MaxRetries is how many times a transient 429/5xx or network error
+	// is retried, with exponential backoff and jitter, before the media
+	// item is marked failed. Defaults to 5.
+	MaxRetries int
+	// OfflineDir, if set, reads media from a local Wordpress
+	// wp-content/uploads directory (matched by file basename) instead
+	// of downloading over the network, for reruns alongside a media
+	// tarball shipped with an export.
+	OfflineDir string
+	// HTTPClient is used for remote downloads. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// DefaultMediaConfig returns sane defaults for downloading post media
+// over the network.
+func DefaultMediaConfig() MediaConfig {
+	return MediaConfig{
+		Concurrency:  runtime.NumCPU(),
+		MaxFileBytes: 25 << 20, // 25MB
+		MaxRetries:   5,
+		HTTPClient:   http.DefaultClient,
+	}
+}
+
+// WithMediaConfig overrides Convert's default media pipeline settings.
+func WithMediaConfig(cfg MediaConfig) Option {
+	return func(c *Convert) {
+		c.media = NewMediaPipeline(cfg)
+	}
+}
+
+// MediaUpload matches store.MediaRepository.Upload, accepting the
+// downloaded file and the uploading user's token.
+type MediaUpload func(file *multipart.FileHeader, token string) (domain.Media, error)
+
+// MediaPipeline downloads the images parseContent discovers, retrying
+// transient failures and deduplicating uploads by content hash so the
+// same image referenced from many posts is only uploaded once. Exported
+// so other importers (e.g. activitypub) can share it rather than
+// re-implementing download/retry/dedupe logic of their own.
+type MediaPipeline struct {
+	client        *http.Client
+	sem           chan struct{}
+	maxFileBytes  int64
+	maxTotalBytes int64
+	spentBytes    int64
+	maxRetries    int
+	offlineDir    string
+
+	mu     sync.Mutex
+	byURL  map[string]mediaFetchResult
+	byHash map[string]string // sha256 hex -> uploaded media.URI
+}
+
+// mediaFetchResult is cached per URL so the same image referenced twice
+// in one post's HTML is only fetched once.
+type mediaFetchResult struct {
+	uri string
+	err error
+}
+
+func NewMediaPipeline(cfg MediaConfig) *MediaPipeline {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = runtime.NumCPU()
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	return &MediaPipeline{
+		client:        cfg.HTTPClient,
+		sem:           make(chan struct{}, cfg.Concurrency),
+		maxFileBytes:  cfg.MaxFileBytes,
+		maxTotalBytes: cfg.MaxTotalBytes,
+		maxRetries:    cfg.MaxRetries,
+		offlineDir:    cfg.OfflineDir,
+		byURL:         map[string]mediaFetchResult{},
+		byHash:        map[string]string{},
+	}
+}
+
+// Fetch downloads url (or reads it from OfflineDir), uploads it through
+// upload unless an identical file has already been uploaded, and
+// returns the resulting media.URI.
+func (m *MediaPipeline) Fetch(url, token string, upload MediaUpload) (string, error) {
+	if uri, err, cached := m.cached(url); cached {
+		return uri, err
+	}
+
+	m.sem <- struct{}{}
+	defer func() { <-m.sem }()
+
+	data, name, err := m.download(url)
+	if err != nil {
+		// Transient failures are never cached: a URL that fails once
+		// (a dropped connection, a 502) must still be retried the next
+		// time a later post references it, not short-circuited for the
+		// rest of the import.
+		return "", err
+	}
+
+	return m.finish(url, name, data, token, upload)
+}
+
+// UploadFetched uploads a file importer.ParseHTML has already downloaded,
+// applying the same size cap, content-hash dedupe and per-URL caching as
+// Fetch without downloading url a second time.
+func (m *MediaPipeline) UploadFetched(fh *multipart.FileHeader, url, token string, upload MediaUpload) (string, error) {
+	if uri, err, cached := m.cached(url); cached {
+		return uri, err
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	if m.maxFileBytes > 0 && int64(len(data)) > m.maxFileBytes {
+		return "", fmt.Errorf("%s exceeds the %d byte file size cap", url, m.maxFileBytes)
+	}
+
+	if err := m.reserveBudget(int64(len(data))); err != nil {
+		return "", err
+	}
+
+	m.sem <- struct{}{}
+	defer func() { <-m.sem }()
+
+	return m.finish(url, fh.Filename, data, token, upload)
+}
+
+// cached reports whether url has already been resolved, returning its
+// cached result. Failed fetches are never cached, so a URL that hit a
+// transient error is retried rather than short-circuited.
+func (m *MediaPipeline) cached(url string) (uri string, err error, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.byURL[url]
+	return r.uri, r.err, ok
+}
+
+// finish hashes data, deduplicating against an identical file already
+// uploaded under a different URL, uploads it if needed, and caches the
+// result under url.
+func (m *MediaPipeline) finish(url, name string, data []byte, token string, upload MediaUpload) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	m.mu.Lock()
+	if uri, ok := m.byHash[hash]; ok {
+		m.mu.Unlock()
+		m.cache(url, uri, nil)
+		return uri, nil
+	}
+	m.mu.Unlock()
+
+	fh, err := newFileHeader(name, data)
+	if err != nil {
+		return "", err
+	}
+
+	media, err := upload(fh, token)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.byHash[hash] = media.URI
+	m.mu.Unlock()
+
+	m.cache(url, media.URI, nil)
+	return media.URI, nil
+}
+
+func (m *MediaPipeline) cache(url, uri string, err error) {
+	m.mu.Lock()
+	m.byURL[url] = mediaFetchResult{uri: uri, err: err}
+	m.mu.Unlock()
+}
+
+// download fetches url, honouring OfflineDir when set.
+func (m *MediaPipeline) download(url string) ([]byte, string, error) {
+	if m.offlineDir != "" {
+		return m.downloadOffline(url)
+	}
+	return m.downloadRemote(url)
+}
+
+// downloadOffline reads a pre-downloaded media tarball extracted
+// alongside the Wordpress export, matching url by file basename.
+func (m *MediaPipeline) downloadOffline(url string) ([]byte, string, error) {
+	name := path.Base(url)
+
+	b, err := ioutil.ReadFile(filepath.Join(m.offlineDir, name))
+	if err != nil {
+		return nil, "", fmt.Errorf("reading offline media %q: %w", name, err)
+	}
+
+	if err := m.reserveBudget(int64(len(b))); err != nil {
+		return nil, "", err
+	}
+
+	return b, name, nil
+}
+
+// downloadRemote fetches url over HTTP, retrying 429/5xx responses and
+// transient network errors with exponential backoff and jitter, and
+// honouring a Retry-After header when the server sends one.
+func (m *MediaPipeline) downloadRemote(url string) ([]byte, string, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= m.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt))
+		}
+
+		b, err := m.attemptDownload(url)
+		if err == nil {
+			if err := m.reserveBudget(int64(len(b))); err != nil {
+				return nil, "", err
+			}
+			return b, path.Base(url), nil
+		}
+
+		if !isRetryable(err) {
+			return nil, "", err
+		}
+
+		lastErr = err
+	}
+
+	return nil, "", fmt.Errorf("giving up downloading %s after %d attempts: %w", url, m.maxRetries+1, lastErr)
+}
+
+// retryableError wraps a transient failure so downloadRemote knows to
+// retry rather than give up immediately.
+type retryableError struct {
+	err error
+}
+
+func (r *retryableError) Error() string { return r.err.Error() }
+func (r *retryableError) Unwrap() error { return r.err }
+
+func isRetryable(err error) bool {
+	_, ok := err.(*retryableError)
+	return ok
+}
+
+func (m *MediaPipeline) attemptDownload(url string) ([]byte, error) {
+	resp, err := m.client.Get(url)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		wait := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		return nil, &retryableError{err: fmt.Errorf("transient status fetching %s: %s", url, resp.Status)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	var reader io.Reader = resp.Body
+	if m.maxFileBytes > 0 {
+		reader = io.LimitReader(resp.Body, m.maxFileBytes+1)
+	}
+
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+
+	if m.maxFileBytes > 0 && int64(len(b)) > m.maxFileBytes {
+		return nil, fmt.Errorf("%s exceeds the %d byte file size cap", url, m.maxFileBytes)
+	}
+
+	return b, nil
+}
+
+// reserveBudget adds n to the running total and fails once
+// MaxTotalBytes has been exceeded.
+func (m *MediaPipeline) reserveBudget(n int64) error {
+	if m.maxTotalBytes <= 0 {
+		return nil
+	}
+
+	if atomic.AddInt64(&m.spentBytes, n) > m.maxTotalBytes {
+		return fmt.Errorf("media download budget of %d bytes exceeded", m.maxTotalBytes)
+	}
+
+	return nil
+}
+
+// retryDelay computes an exponential backoff for the given attempt
+// (1-indexed), capped at 10s, plus up to 50% jitter on top (so at most
+// 15s in all).
+func retryDelay(attempt int) time.Duration {
+	base := 200 * time.Millisecond
+	d := base << uint(attempt-1)
+	if d > 10*time.Second {
+		d = 10 * time.Second
+	}
+
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// parseRetryAfter supports both the delay-seconds and HTTP-date forms
+// of the Retry-After header.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// newFileHeader builds a *multipart.FileHeader from in-memory data by
+// writing it through a multipart.Writer and reading it straight back,
+// since mime/multipart only ever constructs FileHeaders from a parsed
+// request body.
+func newFileHeader(filename string, data []byte) (*multipart.FileHeader, error) {
+	var buf bytes.Buffer
+
+	w := multipart.NewWriter(&buf)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	form, err := multipart.NewReader(&buf, w.Boundary()).ReadForm(int64(len(data)) + 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	files := form.File["file"]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("could not construct a multipart file header for %q", filename)
+	}
+
+	return files[0], nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wordpress
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ainsleyclark/verbis/api/common/encryption"
+	"github.com/ainsleyclark/verbis/api/domain"
+	"github.com/ainsleyclark/verbis/api/importer"
+	"github.com/ainsleyclark/verbis/api/store"
+	"time"
+)
+
+// PasswordPolicy controls the passwords createUser generates for
+// imported authors.
+type PasswordPolicy struct {
+	// Length is the generated password's length in characters.
+	Length int
+	// RequireSymbol requires at least one non-alphanumeric character.
+	RequireSymbol bool
+	// MinEntropyBits is the minimum entropy encryption.CreatePassword
+	// will accept, regenerating until the floor is met.
+	MinEntropyBits float64
+}
+
+// DefaultPasswordPolicy matches the strength encryption.CreatePassword
+// produced before PasswordPolicy existed.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		Length:         16,
+		RequireSymbol:  true,
+		MinEntropyBits: 60,
+	}
+}
+
+// AuthorOnboarding notifies a newly created author of their account.
+// Implementations must never log or persist the plaintext password
+// themselves - it is passed in purely so it can be delivered to the
+// author, not stored.
+type AuthorOnboarding interface {
+	Onboard(user domain.User, password string) error
+}
+
+// NoopNotifier sends no notification at all, for CI runs and
+// WithDryRun imports where no real author should be emailed.
+type NoopNotifier struct{}
+
+// Onboard implements AuthorOnboarding.
+func (NoopNotifier) Onboard(domain.User, string) error { return nil }
+
+// EmailNotifier emails the author their new password directly over
+// SMTP.
+type EmailNotifier struct {
+	Store *store.Repository
+}
+
+// Onboard implements AuthorOnboarding.
+func (e EmailNotifier) Onboard(user domain.User, password string) error {
+	return importer.SendNewPassword(user.HideCredentials(), password, e.Store.Site.GetGlobalConfig())
+}
+
+// MagicLinkNotifier emails the author a one-time login link instead of
+// their password, so the plaintext password never has to leave
+// createUser. The link's token is a cryptographically random value
+// whose hash - not the token itself - is stored via store.LoginTokens,
+// the same way passwords are hashed rather than stored in the clear.
+type MagicLinkNotifier struct {
+	Store *store.Repository
+	// TokenTTL is how long the generated login link stays valid.
+	// Defaults to 24 hours.
+	TokenTTL time.Duration
+}
+
+// Onboard implements AuthorOnboarding.
+func (m MagicLinkNotifier) Onboard(user domain.User, _ string) error {
+	ttl := m.TokenTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	token, err := newLoginToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Store.LoginTokens.Create(domain.LoginToken{
+		UserID:    user.Id,
+		Hash:      hashLoginToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/login/magic?token=%s", m.Store.Site.GetGlobalConfig().SiteURL, token)
+	return importer.SendMagicLink(user.HideCredentials(), link, m.Store.Site.GetGlobalConfig())
+}
+
+// newLoginToken generates a random, URL-safe magic link token.
+func newLoginToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashLoginToken hashes a magic link token before it's persisted, so a
+// database read alone can't be replayed as a valid login.
+func hashLoginToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithOnboarding overrides how Convert notifies newly created authors
+// of their account. Defaults to NoopNotifier.
+func WithOnboarding(o AuthorOnboarding) Option {
+	return func(c *Convert) {
+		c.Onboarding = o
+	}
+}
+
+// WithPasswordPolicy overrides the strength of passwords generated for
+// imported authors.
+func WithPasswordPolicy(p PasswordPolicy) Option {
+	return func(c *Convert) {
+		c.PasswordPolicy = p
+	}
+}
+
+// WithForceResetOnFirstLogin marks every author createUser creates as
+// requiring a password change on their first login, so the auth layer
+// rejects the imported password beyond that point.
+func WithForceResetOnFirstLogin() Option {
+	return func(c *Convert) {
+		c.ForceResetOnFirstLogin = true
+	}
+}
+
+// WithPrintPasswords allows createUser to print generated passwords to
+// stdout, matching the importer's historical (insecure) default.
+// Passwords are never printed unless this is set.
+func WithPrintPasswords() Option {
+	return func(c *Convert) {
+		c.PrintPasswords = true
+	}
+}
+
+// CreatePassword generates a password meeting policy, falling back to
+// DefaultPasswordPolicy when policy is the zero value. Exported so
+// other importers (e.g. activitypub) generate author passwords the
+// same way wordpress.Convert does.
+func CreatePassword(policy PasswordPolicy) string {
+	if policy.Length == 0 {
+		policy = DefaultPasswordPolicy()
+	}
+	return encryption.CreatePassword(policy.Length, policy.RequireSymbol, policy.MinEntropyBits)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Verbis Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wordpress
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gookit/color"
+	"github.com/kyokomi/emoji"
+	"io"
+)
+
+// EventKind identifies which kind of entity a progress Event describes.
+type EventKind string
+
+const (
+	EventPost     EventKind = "post"
+	EventAuthor   EventKind = "author"
+	EventCategory EventKind = "category"
+	EventMedia    EventKind = "media"
+)
+
+// EventStatus describes where an entity is in its import lifecycle.
+type EventStatus string
+
+const (
+	StatusStarted EventStatus = "started"
+	StatusOK      EventStatus = "ok"
+	StatusFailed  EventStatus = "failed"
+)
+
+// Event is emitted to a ProgressWriter every time the importer starts,
+// finishes, or fails to import a post, author, category or media item.
+// Current and Total describe progress through the entity's own Kind,
+// e.g. Current: 3, Total: 120 for the third of 120 posts.
+type Event struct {
+	Kind    EventKind
+	ID      string
+	Status  EventStatus
+	Current int
+	Total   int
+	Err     error
+}
+
+// ProgressWriter receives a stream of Events as an import progresses.
+// Convert's post worker pool and its own goroutine send Events over a
+// channel that a single goroutine drains, so one Convert never calls
+// WriteProgress concurrently; an implementation shared between several
+// imports running at once must be safe for concurrent use.
+type ProgressWriter interface {
+	WriteProgress(Event)
+}
+
+// TerminalProgressWriter renders Events as human readable, emoji
+// prefixed lines, matching the summary Import used to print directly.
+type TerminalProgressWriter struct {
+	Out io.Writer
+}
+
+// NewTerminalProgressWriter creates a TerminalProgressWriter that
+// writes to out.
+func NewTerminalProgressWriter(out io.Writer) *TerminalProgressWriter {
+	return &TerminalProgressWriter{Out: out}
+}
+
+// WriteProgress implements ProgressWriter.
+func (t *TerminalProgressWriter) WriteProgress(e Event) {
+	switch e.Status {
+	case StatusOK:
+		line := color.Green.Sprintf("[%d/%d] %s %s imported", e.Current, e.Total, e.Kind, e.ID)
+		fmt.Fprintln(t.Out, emoji.Sprint(":check_mark:"), line)
+	case StatusFailed:
+		line := color.Red.Sprintf("[%d/%d] %s %s failed: %s", e.Current, e.Total, e.Kind, e.ID, e.Err)
+		fmt.Fprintln(t.Out, emoji.Sprint(":cross_mark:"), line)
+	case StatusStarted:
+		fmt.Fprintf(t.Out, "[%d/%d] importing %s %s\n", e.Current, e.Total, e.Kind, e.ID)
+	}
+}
+
+// jsonEvent is the wire format written by JSONProgressWriter. Err is
+// flattened to a string so the stream stays valid JSON Lines.
+type jsonEvent struct {
+	Kind    EventKind   `json:"kind"`
+	ID      string      `json:"id"`
+	Status  EventStatus `json:"status"`
+	Current int         `json:"current"`
+	Total   int         `json:"total"`
+	Err     string      `json:"error,omitempty"`
+}
+
+// JSONProgressWriter renders Events as newline delimited JSON, suitable
+// for piping to a webhook or persisting to a debug table.
+type JSONProgressWriter struct {
+	Out io.Writer
+}
+
+// NewJSONProgressWriter creates a JSONProgressWriter that writes to out.
+func NewJSONProgressWriter(out io.Writer) *JSONProgressWriter {
+	return &JSONProgressWriter{Out: out}
+}
+
+// WriteProgress implements ProgressWriter.
+func (j *JSONProgressWriter) WriteProgress(e Event) {
+	je := jsonEvent{
+		Kind:    e.Kind,
+		ID:      e.ID,
+		Status:  e.Status,
+		Current: e.Current,
+		Total:   e.Total,
+	}
+	if e.Err != nil {
+		je.Err = e.Err.Error()
+	}
+
+	b, err := json.Marshal(je)
+	if err != nil {
+		return
+	}
+
+	b = append(b, '\n')
+	_, _ = j.Out.Write(b)
+}
@@ -5,40 +5,59 @@
 package wordpress
 
 import (
+	"context"
 	"fmt"
-	"github.com/ainsleyclark/verbis/api/common/encryption"
 	"github.com/ainsleyclark/verbis/api/domain"
 	"github.com/ainsleyclark/verbis/api/errors"
 	"github.com/ainsleyclark/verbis/api/importer"
 	"github.com/ainsleyclark/verbis/api/store"
 	"github.com/gookit/color"
-	"github.com/kyokomi/emoji"
 	"mime/multipart"
+	"os"
 	"runtime"
-	"strings"
 	"sync"
-)
-
-const maxCPUNum = 4
-
-// TODO: This needs to be dynamic.
-var (
-	resource   = "news"
-	layout     = "main"
-	template   = "news-single"
-	fieldUUID  = "2dedc760-5016-11eb-ae93-0242ac130002"
-	userRoleID = 2
-	trackChan  = make(chan int, runtime.NumCPU()*maxCPUNum)
-	wg         = sync.WaitGroup{}
+	"sync/atomic"
 )
 
 type Convert struct {
-	XML       WpXML
-	failed    Failures
-	store     *store.Repository
-	authors   domain.Users
-	owner     domain.User
-	sendEmail bool
+	XML         WpXML
+	source      string
+	store       *store.Repository
+	owner       domain.User
+	sendEmail   bool
+	authors     domain.Users
+	authorsMu   sync.Mutex
+	failed      Failures
+	failedMu    sync.Mutex
+	jobID       string
+	resuming    bool
+	// Config declares how Wordpress posts are mapped onto Verbis
+	// resources, layouts, templates and content fields.
+	Config *ImporterConfig
+	// Concurrency is the number of workers used to import posts
+	// concurrently. Defaults to runtime.NumCPU() when left at zero.
+	Concurrency int
+	// Progress receives a stream of Events as the import runs. Defaults
+	// to a TerminalProgressWriter writing to os.Stdout.
+	Progress ProgressWriter
+	// DryRun, set via WithDryRun, skips writing Posts, Users and
+	// Categories and only records checkpoints of what would happen.
+	DryRun bool
+	// Onboarding notifies newly created authors of their account.
+	// Defaults to NoopNotifier.
+	Onboarding AuthorOnboarding
+	// PasswordPolicy controls the strength of passwords createUser
+	// generates for imported authors.
+	PasswordPolicy PasswordPolicy
+	// ForceResetOnFirstLogin, set via WithForceResetOnFirstLogin, marks
+	// every imported author as requiring a password change on their
+	// first login.
+	ForceResetOnFirstLogin bool
+	// PrintPasswords, set via WithPrintPasswords, allows createUser to
+	// print generated passwords to stdout. Passwords are never printed
+	// otherwise.
+	PrintPasswords bool
+	media          *MediaPipeline
 }
 
 type Result struct {
@@ -49,46 +68,84 @@ type Result struct {
 }
 
 // New - Construct
-func New(xmlPath string, s *store.Repository, sendEmail bool) (*Convert, error) {
+//
+// cfg declares how Wordpress posts are mapped onto Verbis resources.
+// Pass DefaultImporterConfig() to reproduce the importer's previous,
+// hard coded "news" mapping. Pass WithResume to pick up a previously
+// started import exactly where it left off, or WithDryRun to preview
+// an import without writing any Posts, Users or Categories.
+func New(xmlPath string, s *store.Repository, sendEmail bool, cfg *ImporterConfig, opts ...Option) (*Convert, error) {
 	wp := NewWordpressXML()
 	err := wp.ReadFile(xmlPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Convert{
-		XML:       wp,
-		failed:    Failures{},
-		store:     s,
-		owner:     s.User.Owner(),
-		sendEmail: sendEmail,
-	}, nil
+	if cfg == nil {
+		cfg = DefaultImporterConfig()
+	}
+
+	c := &Convert{
+		XML:            wp,
+		source:         xmlPath,
+		failed:         Failures{},
+		store:          s,
+		owner:          s.User.Owner(),
+		sendEmail:      sendEmail,
+		Concurrency:    runtime.NumCPU(),
+		Progress:       NewTerminalProgressWriter(os.Stdout),
+		Config:         cfg,
+		media:          NewMediaPipeline(DefaultMediaConfig()),
+		Onboarding:     NoopNotifier{},
+		PasswordPolicy: DefaultPasswordPolicy(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
 }
 
 // Import
 //
 // The XML file into Wordpress by populating Authors
-// and Posts.
-func (c *Convert) Import() {
-	authors := c.populateAuthors()
-	posts, categories := c.populatePosts()
+// and Posts. The context may be cancelled by the caller
+// to abort an in-flight import; workers that are already
+// running are given the chance to finish their current item.
+// Progress is reported in real time through Convert.Progress.
+//
+// Import is idempotent: every post, author and category is checkpointed
+// against its Wordpress guid, email or slug, so re-running a failed or
+// cancelled import (via WithResume) will not create duplicates.
+func (c *Convert) Import(ctx context.Context) (Result, error) {
+	err := c.startJob()
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.finishJob()
+
+	out := make(chan Event, 64)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for e := range out {
+			c.Progress.WriteProgress(e)
+		}
+	}()
+
+	authors := c.populateAuthors(out)
+	posts, categories := c.populatePosts(ctx, out)
+
+	close(out)
+	<-drained
 
-	r := Result{
+	return Result{
 		Failed:     c.failed,
 		Posts:      posts,
 		Authors:    authors,
 		Categories: categories,
-	}
-
-	// TODO: To be returned here as a WebHook or placed in a Debug Table
-	emoji.Println(":check_mark: Successful entries:")
-	fmt.Printf("Posts: %d\n", len(r.Posts))
-	fmt.Printf("Authors: %d\n", len(r.Authors))
-	fmt.Printf("Categories: %d\n", len(r.Authors))
-	fmt.Println()
-	emoji.Println(":cross_mark: Failed entries")
-	fmt.Printf("Posts: %d\n", len(r.Failed.Posts))
-	fmt.Printf("Authors: %d\n", len(r.Failed.Authors))
+	}, nil
 }
 
 // Failed import defines the errors that occurred when importing
@@ -119,23 +176,64 @@ type FailedAuthor struct {
 	Error     error
 }
 
-var (
-	posts      domain.PostData   // Successful posts that have been inserted
-	categories domain.Categories // Successful categories that have been inserted
-)
-
 // populatePosts
 //
-// Loops over all of the Wordpress item and creates a Verbis post.
-// Spawns a new process to insert into the database.
-func (c *Convert) populatePosts() (domain.PostData, domain.Categories) {
-	posts = domain.PostData{}
-	categories = domain.Categories{}
+// Spawns a bounded pool of workers (sized by Convert.Concurrency) that
+// consume Wordpress items off a shared channel and insert them as Verbis
+// posts concurrently. Successful posts and categories are collected behind
+// a mutex so the pool can be scaled without risking lost or duplicated
+// writes. The pool stops taking on new items as soon as ctx is done, but
+// lets in-flight items finish.
+func (c *Convert) populatePosts(ctx context.Context, out chan<- Event) (domain.PostData, domain.Categories) {
+	var (
+		mu         sync.Mutex
+		posts      = domain.PostData{}
+		categories = domain.Categories{}
+	)
+
+	total := len(c.XML.Channel.Items)
+	var current int64
+
+	workers := c.Concurrency
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	in := make(chan Item)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				cur := int(atomic.AddInt64(&current, 1))
+				out <- Event{Kind: EventPost, ID: item.Link, Status: StatusStarted, Current: cur, Total: total}
+
+				post, category, ok := c.addItem(item, out, cur, total)
+				if !ok {
+					continue
+				}
+
+				mu.Lock()
+				posts = append(posts, post)
+				if category != nil {
+					categories = append(categories, *category)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
+feed:
 	for _, item := range c.XML.Channel.Items {
-		trackChan <- 1
-		go c.addItem(item)
+		select {
+		case <-ctx.Done():
+			break feed
+		case in <- item:
+		}
 	}
+	close(in)
 
 	wg.Wait()
 
@@ -144,39 +242,56 @@ func (c *Convert) populatePosts() (domain.PostData, domain.Categories) {
 
 // addItem
 //
-// This function will append to the FailedPosts array if there
-// was a problem parsing any of the content.
-func (c *Convert) addItem(item Item) {
-	wg.Add(1)
-	defer func() {
-		wg.Done()
-		<-trackChan
-	}()
+// Parses a single Wordpress item and creates the corresponding Verbis
+// post. Safe to call from multiple goroutines concurrently: it only ever
+// touches the Item it was given and reports outcomes through its return
+// values and failPost, never through shared package state.
+//
+// Returns the created post and, if the item carried one, its category.
+// ok is false if the item could not be imported, in which case it has
+// already been appended to Convert.failed and a failed Event has been
+// sent to out.
+func (c *Convert) addItem(item Item, out chan<- Event, current, total int) (post domain.Post, category *domain.Category, ok bool) {
+	fail := func(err error) {
+		c.failPost(item, nil, err)
+		out <- Event{Kind: EventPost, ID: item.Link, Status: StatusFailed, Current: current, Total: total, Err: err}
+	}
+
+	if existing, found := c.checkpoint(EventPost, item.GUID); found && existing.Status == checkpointOK {
+		out <- Event{Kind: EventPost, ID: item.Link, Status: StatusOK, Current: current, Total: total}
+		return domain.Post{Id: existing.VerbisID}, nil, true
+	}
+
+	rule, err := c.Config.RuleFor(item.Categories)
+	if err != nil {
+		fail(err)
+		return domain.Post{}, nil, false
+	}
 
 	link, err := importer.ParseLink(item.Link)
 	if err != nil {
-		c.failPost(item, nil, err)
-		return
+		fail(err)
+		return domain.Post{}, nil, false
 	}
 
-	uuid, err := importer.ParseUUID(fieldUUID)
+	uuid, err := importer.ParseUUID(rule.ContentField.UUID)
 	if err != nil {
 		c.failPost(item, nil, err)
 	}
 
-	content, failed, err := c.parseContent(item.Content)
+	content, failed, err := c.parseContent(item.Content, out)
 	if err != nil {
 		c.failPost(item, failed, err)
 	}
 
 	p := domain.PostCreate{
 		Post: domain.Post{
-			Slug:         fmt.Sprintf("/%v/%v", resource, strings.ReplaceAll(link, "/", "")),
+			Slug:         rule.RenderSlug(link, item.PubDatetime.Year()),
 			Title:        item.Title,
 			Status:       getStatus(item.Status),
-			Resource:     resource,
-			PageTemplate: template,
-			PageLayout:   layout,
+			Resource:     rule.Resource,
+			PageTemplate: rule.PageTemplate,
+			PageLayout:   rule.PageLayout,
 			PublishedAt:  &item.PubDatetime,
 			CreatedAt:    item.PostDatetime,
 			UpdatedAt:    item.PostDatetime,
@@ -186,31 +301,41 @@ func (c *Convert) addItem(item Item) {
 		Fields: domain.PostFields{
 			{
 				UUID:          uuid,
-				Type:          "richtext",
+				Type:          string(rule.ContentField.Type),
 				Name:          "content",
 				OriginalValue: domain.FieldValue(content),
 			},
 		},
 	}
 
-	category, err := c.getCategory(item.Categories)
+	cat, err := c.getCategory(item.Categories, rule)
 	if err != nil && errors.Code(err) != errors.NOTFOUND {
 		c.failPost(item, nil, err)
-		categories = append(categories, category)
 	}
 
 	if err == nil {
-		cid := category.Id
+		cid := cat.Id
 		p.Category = &cid
+		category = &cat
+	}
+
+	if c.DryRun {
+		c.writeCheckpoint(EventPost, item.GUID, 0, checkpointDryRun)
+		out <- Event{Kind: EventPost, ID: item.Link, Status: StatusOK, Current: current, Total: total}
+		return domain.Post{}, category, true
 	}
 
-	post, err := c.store.Posts.Create(p)
+	post, err = c.store.Posts.Create(p)
 	if err != nil {
-		c.failPost(item, nil, err)
-		return
+		c.writeCheckpoint(EventPost, item.GUID, 0, checkpointFailed)
+		fail(err)
+		return domain.Post{}, nil, false
 	}
 
-	posts = append(posts, post)
+	c.writeCheckpoint(EventPost, item.GUID, post.Id, checkpointOK)
+	out <- Event{Kind: EventPost, ID: item.Link, Status: StatusOK, Current: current, Total: total}
+
+	return post, category, true
 }
 
 // parseContent
@@ -223,22 +348,43 @@ func (c *Convert) addItem(item Item) {
 //
 // Returns the modified HTML file, the FailedMedia array and an error
 // if there was a problem parsing the HTML.
-func (c *Convert) parseContent(content string) (string, []FailedMedia, error) {
+func (c *Convert) parseContent(content string, out chan<- Event) (string, []FailedMedia, error) {
 	var failed []FailedMedia
-	parsed, err := importer.ParseHTML(content, func(file *multipart.FileHeader, url string, err error) string {
+	parsed, err := importer.ParseHTML(content, func(fh *multipart.FileHeader, url string, err error) string {
+		if err != nil && !c.DryRun {
+			// ParseHTML made a single download attempt and it failed;
+			// retry url through the pipeline's own retrying download,
+			// which also honours MediaConfig.OfflineDir.
+			uri, ferr := c.media.Fetch(url, c.owner.Token, c.store.Media.Upload)
+			if ferr == nil {
+				out <- Event{Kind: EventMedia, ID: url, Status: StatusOK}
+				return uri
+			}
+			err = ferr
+		}
+
 		if err != nil {
 			failed = append(failed, FailedMedia{URL: url, Error: err})
+			out <- Event{Kind: EventMedia, ID: url, Status: StatusFailed, Err: err}
+			return ""
+		}
+
+		if c.DryRun {
+			out <- Event{Kind: EventMedia, ID: url, Status: StatusOK}
 			return ""
 		}
 
-		//media, err := c.store.Media.Upload(file, c.owner.Token)
-		//if err != nil {
-		//	failed = append(failed, FailedMedia{URI: url, Error: err})
-		//	return ""
-		//}
-		//
-		//return media.URI
-		return ""
+		// ParseHTML has already downloaded url for us; upload the file
+		// it fetched instead of downloading url a second time.
+		uri, uerr := c.media.UploadFetched(fh, url, c.owner.Token, c.store.Media.Upload)
+		if uerr != nil {
+			failed = append(failed, FailedMedia{URL: url, Error: uerr})
+			out <- Event{Kind: EventMedia, ID: url, Status: StatusFailed, Err: uerr}
+			return ""
+		}
+
+		out <- Event{Kind: EventMedia, ID: url, Status: StatusOK}
+		return uri
 	})
 
 	if err != nil {
@@ -255,7 +401,7 @@ func (c *Convert) parseContent(content string) (string, []FailedMedia, error) {
 // Returns found category if it already exists.
 // Returns newly created category if it doesnt exist.
 // Returns errors.NOTFOUND if not category is attached to the post.
-func (c *Convert) getCategory(categories []Category) (domain.Category, error) {
+func (c *Convert) getCategory(categories []Category, rule MappingRule) (domain.Category, error) {
 	const op = "WordpressConvertor.getCategory"
 
 	if len(categories) == 0 {
@@ -264,11 +410,30 @@ func (c *Convert) getCategory(categories []Category) (domain.Category, error) {
 
 	wp := categories[0]
 
-	return c.store.Categories.Create(domain.Category{
+	cat := domain.Category{
 		Slug:     wp.URLSlug,
 		Name:     wp.DisplayName,
-		Resource: resource,
-	})
+		Resource: rule.Resource,
+	}
+
+	if existing, found := c.checkpoint(EventCategory, wp.URLSlug); found && existing.Status == checkpointOK {
+		cat.Id = existing.VerbisID
+		return cat, nil
+	}
+
+	if c.DryRun {
+		c.writeCheckpoint(EventCategory, wp.URLSlug, 0, checkpointDryRun)
+		return cat, nil
+	}
+
+	created, err := c.store.Categories.Create(cat)
+	if err != nil {
+		c.writeCheckpoint(EventCategory, wp.URLSlug, 0, checkpointFailed)
+		return created, err
+	}
+
+	c.writeCheckpoint(EventCategory, wp.URLSlug, created.Id, checkpointOK)
+	return created, nil
 }
 
 // getSeoMeta
@@ -303,7 +468,10 @@ func (c *Convert) getSeoMeta(title string, meta []Meta) domain.PostOptions {
 // findAuthor
 //
 // Looks through the array of authors attached to the Convert
-// struct and returns the Author ID.
+// struct and returns the Author ID. Safe to call from the post
+// worker pool: populateAuthors has always finished building
+// Convert.authors by the time populatePosts starts, but the lock
+// is taken anyway so the two never need to be ordered by hand.
 //
 // Returns owner ID if there was an error obtaining the Wordpress
 // authors or no author exists in the Convert authors array.
@@ -313,6 +481,9 @@ func (c *Convert) findAuthor(item Item) int {
 		return c.owner.Id
 	}
 
+	c.authorsMu.Lock()
+	defer c.authorsMu.Unlock()
+
 	for _, v := range c.authors {
 		if v.Email == author.AuthorEmail {
 			return v.Id
@@ -329,40 +500,49 @@ func (c *Convert) findAuthor(item Item) int {
 // sent with there their password. If they do exist, the author
 // will be appended to the Convert author array.
 // The user will be added to the FailedAuthors array in any case of error.
-func (c *Convert) populateAuthors() domain.UsersParts {
+func (c *Convert) populateAuthors(out chan<- Event) domain.UsersParts {
 	var users domain.UsersParts
 
-	for _, v := range c.XML.Channel.Authors {
+	total := len(c.XML.Channel.Authors)
+	for i, v := range c.XML.Channel.Authors {
+		current := i + 1
+		out <- Event{Kind: EventAuthor, ID: v.AuthorEmail, Status: StatusStarted, Current: current, Total: total}
+
 		exists := c.store.User.ExistsByEmail(v.AuthorEmail)
 		if !exists {
 			user, password, err := c.createUser(v)
 			if err != nil {
+				out <- Event{Kind: EventAuthor, ID: v.AuthorEmail, Status: StatusFailed, Current: current, Total: total, Err: err}
 				continue
 			}
 
-			color.Green.Println(fmt.Sprintf("User: %s Password: %s", user.Email, password))
+			if c.PrintPasswords {
+				color.Green.Println(fmt.Sprintf("User: %s Password: %s", user.Email, password))
+			}
 
-			// if c.sendEmail {
-			// User can't login!
-			// FIX HERE
-			//err = importer.SendNewPassword(user.HideCredentials(), password, c.store.Site.GetGlobalConfig())
-			//if err != nil {
-			//	color.Red.Println(err)
-			//	continue
-			//}
-			//}
+			if c.sendEmail && !c.DryRun {
+				if err := c.Onboarding.Onboard(user, password); err != nil {
+					color.Red.Println(err)
+				}
+			}
 
 			users = append(users, user.HideCredentials())
+			out <- Event{Kind: EventAuthor, ID: v.AuthorEmail, Status: StatusOK, Current: current, Total: total}
 			continue
 		}
 
 		user, err := c.store.User.FindByEmail(v.AuthorEmail)
 		if err != nil {
 			c.failAuthor(v.AuthorFirstName, v.AuthorLastName, v.AuthorEmail, err)
+			out <- Event{Kind: EventAuthor, ID: v.AuthorEmail, Status: StatusFailed, Current: current, Total: total, Err: err}
 			continue
 		}
 
+		c.authorsMu.Lock()
 		c.authors = append(c.authors, user)
+		c.authorsMu.Unlock()
+
+		out <- Event{Kind: EventAuthor, ID: v.AuthorEmail, Status: StatusOK, Current: current, Total: total}
 	}
 
 	return users
@@ -372,21 +552,24 @@ func (c *Convert) populateAuthors() domain.UsersParts {
 //
 // Generates a new password and continues to create a new User
 // from the repository. If the user failed to be created it
-// will be added to the FailedAuthors array.
+// will be added to the FailedAuthors array. Authors aren't tied to a
+// single Wordpress category, so the new user is given the Config
+// Default rule's author role.
 //
 // Returns the newly created password if successful.
 // Returns an error if the user could not be created.
 func (c *Convert) createUser(a Author) (domain.User, string, error) {
-	password := encryption.CreatePassword()
+	password := CreatePassword(c.PasswordPolicy)
 
 	user := domain.UserCreate{
 		User: domain.User{
 			UserPart: domain.UserPart{
-				FirstName: a.AuthorFirstName,
-				LastName:  a.AuthorLastName,
-				Email:     a.AuthorEmail,
+				FirstName:          a.AuthorFirstName,
+				LastName:           a.AuthorLastName,
+				Email:              a.AuthorEmail,
+				ForcePasswordReset: c.ForceResetOnFirstLogin,
 				Role: domain.Role{
-					Id: userRoleID,
+					Id: c.Config.Default.AuthorRoleID,
 				},
 			},
 		},
@@ -394,13 +577,23 @@ func (c *Convert) createUser(a Author) (domain.User, string, error) {
 		ConfirmPassword: password,
 	}
 
+	if c.DryRun {
+		c.writeCheckpoint(EventAuthor, a.AuthorEmail, 0, checkpointDryRun)
+		return user.User, password, nil
+	}
+
 	u, err := c.store.User.Create(user)
 	if err != nil {
 		c.failAuthor(a.AuthorFirstName, a.AuthorLastName, a.AuthorEmail, err)
+		c.writeCheckpoint(EventAuthor, a.AuthorEmail, 0, checkpointFailed)
 		return domain.User{}, "", err
 	}
 
+	c.authorsMu.Lock()
 	c.authors = append(c.authors, u)
+	c.authorsMu.Unlock()
+
+	c.writeCheckpoint(EventAuthor, a.AuthorEmail, u.Id, checkpointOK)
 
 	return user.User, password, nil
 }
@@ -419,6 +612,8 @@ func getStatus(status string) string {
 //
 // Append to the failed posts array.
 func (c *Convert) failPost(item Item, media []FailedMedia, err error) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
 	c.failed.Posts = append(c.failed.Posts, FailedPost{
 		Post:  item,
 		Media: media,
@@ -430,6 +625,8 @@ func (c *Convert) failPost(item Item, media []FailedMedia, err error) {
 //
 // Append to the failed authors array.
 func (c *Convert) failAuthor(fName, lName, email string, err error) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
 	c.failed.Authors = append(c.failed.Authors, FailedAuthor{
 		FirstName: fName,
 		LastName:  lName,